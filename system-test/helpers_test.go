@@ -0,0 +1,489 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e2e
+
+// This file holds helpers for the integration test which do not need GCP.
+// It has no build tag, so their tests run without credentials.
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// maxResourceNameLen is the longest name Compute Engine accepts for a
+// resource.
+const maxResourceNameLen = 63
+
+// runID identifies this run of the test in the names of the resources it
+// creates. Its random part keeps names unique across runs started in the same
+// second.
+var runID = newRunID(time.Now())
+
+// newRunID returns t in UTC followed by a random hex suffix, in a form which
+// can be used in resource names.
+func newRunID(t time.Time) string {
+	b := make([]byte, 3)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to generate run ID: %v", err))
+	}
+	return fmt.Sprintf("%s-%x", t.UTC().Format("20060102-150405"), b)
+}
+
+// resourceName returns prefix followed by runID, as a valid Compute Engine
+// resource name: lowercase letters, digits and hyphens, at most
+// maxResourceNameLen characters long. prefix should start with a letter.
+// Other characters in it which are not allowed are replaced with hyphens, and
+// it is truncated if the name would be too long.
+func resourceName(prefix string) string {
+	suffix := "-" + runID
+	prefix = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(prefix))
+	if max := maxResourceNameLen - len(suffix); len(prefix) > max {
+		prefix = prefix[:max]
+	}
+	return strings.TrimRight(prefix, "-") + suffix
+}
+
+// googleapisDialAddress returns the address to connect to for addr. If
+// override is set and addr is on googleapis.com, override is returned, so that
+// requests for Google APIs reach a private or restricted endpoint while TLS
+// still verifies the original host name.
+func googleapisDialAddress(addr, override string) string {
+	if override == "" {
+		return addr
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if host == "googleapis.com" || strings.HasSuffix(host, ".googleapis.com") {
+		return override
+	}
+	return addr
+}
+
+// loggingTransport logs the method, URL and outcome of each request sent
+// through it.
+type loggingTransport struct {
+	base http.RoundTripper
+	logf func(format string, args ...interface{})
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		t.logf("%s %s: error after %v: %v", req.Method, req.URL, time.Since(start), err)
+		return nil, err
+	}
+	t.logf("%s %s: %s after %v", req.Method, req.URL, resp.Status, time.Since(start))
+	return resp, nil
+}
+
+// userProjectTransport sets the X-Goog-User-Project header on each request
+// sent through it, so that the request's quota and billing are charged to
+// project.
+type userProjectTransport struct {
+	base    http.RoundTripper
+	project string
+}
+
+func (t *userProjectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Goog-User-Project", t.project)
+	return t.base.RoundTrip(req)
+}
+
+// parseFailurePatterns splits the comma-separated list s into patterns,
+// trimming spaces around each and dropping empty ones.
+func parseFailurePatterns(s string) []string {
+	var patterns []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// failureLines returns each line of output which contains one of patterns.
+func failureLines(output string, patterns []string) []string {
+	var lines []string
+	for _, line := range strings.Split(output, "\n") {
+		for _, pattern := range patterns {
+			if strings.Contains(line, pattern) {
+				lines = append(lines, line)
+				break
+			}
+		}
+	}
+	return lines
+}
+
+// markerTime returns the Unix time printed after marker in output.
+func markerTime(output, marker string) (time.Time, error) {
+	m := regexp.MustCompile(regexp.QuoteMeta(marker) + ` (\d+)`).FindStringSubmatch(output)
+	if m == nil {
+		return time.Time{}, fmt.Errorf("%q followed by a time not found in serial output", marker)
+	}
+	sec, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse time after %q: %v", marker, err)
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// benchmarkRunDuration returns the time between the startMarker and endMarker
+// lines in output, as measured by the clock of the instance which ran the
+// benchmark.
+func benchmarkRunDuration(output, startMarker, endMarker string) (time.Duration, error) {
+	start, err := markerTime(output, startMarker)
+	if err != nil {
+		return 0, err
+	}
+	end, err := markerTime(output, endMarker)
+	if err != nil {
+		return 0, err
+	}
+	return end.Sub(start), nil
+}
+
+// logProgress calls logf every interval to say how long it has been waiting
+// for what, until the returned stop function is called.
+func logProgress(logf func(format string, args ...interface{}), interval time.Duration, what string) (stop func()) {
+	start := time.Now()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				logf("still waiting for %s, %v elapsed", what, time.Since(start).Round(time.Second))
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func TestParseFailurePatterns(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		s    string
+		want []string
+	}{
+		{
+			name: "empty",
+			s:    "",
+		},
+		{
+			name: "default",
+			s:    "UnhandledPromiseRejectionWarning,Failed to initialize SourceMapper",
+			want: []string{"UnhandledPromiseRejectionWarning", "Failed to initialize SourceMapper"},
+		},
+		{
+			name: "spaces after commas",
+			s:    "Error:, uncaughtException",
+			want: []string{"Error:", "uncaughtException"},
+		},
+		{
+			name: "empty entries",
+			s:    "Error:,, ,uncaughtException,",
+			want: []string{"Error:", "uncaughtException"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := parseFailurePatterns(tc.s); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseFailurePatterns(%q) got %q, want %q", tc.s, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFailureLines(t *testing.T) {
+	patterns := []string{"UnhandledPromiseRejectionWarning", "Failed to initialize SourceMapper"}
+	for _, tc := range []struct {
+		name   string
+		output string
+		want   []string
+	}{
+		{
+			name:   "no match",
+			output: "starting benchmark\nbenchmark application(s) complete",
+		},
+		{
+			name:   "one match",
+			output: "starting benchmark\n(node:123) UnhandledPromiseRejectionWarning: Error: boom\nbenchmark application(s) complete",
+			want:   []string{"(node:123) UnhandledPromiseRejectionWarning: Error: boom"},
+		},
+		{
+			name:   "several lines match",
+			output: "@google-cloud/profiler Failed to initialize SourceMapper. Source map support has been disabled\nstarting benchmark\n(node:123) UnhandledPromiseRejectionWarning: Error: boom",
+			want: []string{
+				"@google-cloud/profiler Failed to initialize SourceMapper. Source map support has been disabled",
+				"(node:123) UnhandledPromiseRejectionWarning: Error: boom",
+			},
+		},
+		{
+			name:   "one line matches two patterns",
+			output: "UnhandledPromiseRejectionWarning: Failed to initialize SourceMapper\nbenchmark application(s) complete",
+			want:   []string{"UnhandledPromiseRejectionWarning: Failed to initialize SourceMapper"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := failureLines(tc.output, patterns); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("failureLines() got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBenchmarkRunDuration(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		output  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{
+			name:   "both markers",
+			output: "started at 1600000000\nrunning\nended at 1600000610",
+			want:   610 * time.Second,
+		},
+		{
+			name:    "missing start marker",
+			output:  "running\nended at 1600000610",
+			wantErr: true,
+		},
+		{
+			name:    "missing end marker",
+			output:  "started at 1600000000\nrunning",
+			wantErr: true,
+		},
+		{
+			name:    "marker without a time",
+			output:  "started at \nrunning\nended at 1600000610",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := benchmarkRunDuration(tc.output, "started at", "ended at")
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("benchmarkRunDuration() got %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("benchmarkRunDuration() got error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("benchmarkRunDuration() got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewRunID(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("UTC-7", -7*60*60))
+	first, second := newRunID(ts), newRunID(ts)
+	want := regexp.MustCompile(`^20200102-100405-[0-9a-f]{6}$`)
+	if !want.MatchString(first) {
+		t.Errorf("newRunID() got %q, want a match for %s", first, want)
+	}
+	if first == second {
+		t.Errorf("newRunID() got %q twice, want a different random suffix", first)
+	}
+}
+
+func TestResourceName(t *testing.T) {
+	valid := regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+	for _, tc := range []struct {
+		name   string
+		prefix string
+		want   string
+	}{
+		{
+			name:   "valid prefix",
+			prefix: "profiler-test-node12",
+			want:   "profiler-test-node12-" + runID,
+		},
+		{
+			name:   "invalid characters",
+			prefix: "Profiler_Test.Node12",
+			want:   "profiler-test-node12-" + runID,
+		},
+		{
+			name:   "prefix too long",
+			prefix: strings.Repeat("a", maxResourceNameLen),
+			want:   strings.Repeat("a", maxResourceNameLen-len(runID)-1) + "-" + runID,
+		},
+		{
+			name:   "truncated prefix ending in a hyphen",
+			prefix: strings.Repeat("a", maxResourceNameLen-len(runID)-2) + "-b",
+			want:   strings.Repeat("a", maxResourceNameLen-len(runID)-2) + "-" + runID,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := resourceName(tc.prefix)
+			if got != tc.want {
+				t.Errorf("resourceName(%q) got %q, want %q", tc.prefix, got, tc.want)
+			}
+			if len(got) > maxResourceNameLen || !valid.MatchString(got) {
+				t.Errorf("resourceName(%q) got %q, which is not a valid resource name", tc.prefix, got)
+			}
+		})
+	}
+}
+
+func TestGoogleapisDialAddress(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		addr     string
+		override string
+		want     string
+	}{
+		{
+			name: "no override",
+			addr: "cloudprofiler.googleapis.com:443",
+			want: "cloudprofiler.googleapis.com:443",
+		},
+		{
+			name:     "google api",
+			addr:     "cloudprofiler.googleapis.com:443",
+			override: "restricted.googleapis.com:443",
+			want:     "restricted.googleapis.com:443",
+		},
+		{
+			name:     "other host",
+			addr:     "github.com:443",
+			override: "restricted.googleapis.com:443",
+			want:     "github.com:443",
+		},
+		{
+			name:     "host which only ends with googleapis.com",
+			addr:     "notgoogleapis.com:443",
+			override: "restricted.googleapis.com:443",
+			want:     "notgoogleapis.com:443",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := googleapisDialAddress(tc.addr, tc.override); got != tc.want {
+				t.Errorf("googleapisDialAddress(%q, %q) got %q, want %q", tc.addr, tc.override, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoggingTransport(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	var logs []string
+	client := &http.Client{Transport: &loggingTransport{
+		base: http.DefaultTransport,
+		logf: func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	}}
+	resp, err := client.Get(server.URL + "/profiles")
+	if err != nil {
+		t.Fatalf("Get() got error: %v", err)
+	}
+	resp.Body.Close()
+
+	wantPrefix := "GET " + server.URL + "/profiles: 404 Not Found after "
+	if len(logs) != 1 || !strings.HasPrefix(logs[0], wantPrefix) {
+		t.Errorf("got logs %q, want one log starting with %q", logs, wantPrefix)
+	}
+}
+
+func TestUserProjectTransport(t *testing.T) {
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-Goog-User-Project")
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &userProjectTransport{base: http.DefaultTransport, project: "quota-project"}}
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatalf("NewRequest() got error: %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do() got error: %v", err)
+	}
+	resp.Body.Close()
+
+	if got != "quota-project" {
+		t.Errorf("server got X-Goog-User-Project %q, want %q", got, "quota-project")
+	}
+	if h := req.Header.Get("X-Goog-User-Project"); h != "" {
+		t.Errorf("caller's request got X-Goog-User-Project %q, want it left unset", h)
+	}
+}
+
+func TestLogProgress(t *testing.T) {
+	var mu sync.Mutex
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	numLogs := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(logs)
+	}
+
+	stop := logProgress(logf, time.Millisecond, "benchmark")
+	for deadline := time.Now().Add(5 * time.Second); numLogs() < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d logs after 5s, want at least 2", numLogs())
+		}
+	}
+	stop()
+	n := numLogs()
+	time.Sleep(20 * time.Millisecond)
+	if got := numLogs(); got != n {
+		t.Errorf("got %d logs after stop, want %d", got, n)
+	}
+	if want := "still waiting for benchmark, "; !strings.HasPrefix(logs[0], want) {
+		t.Errorf("got log %q, want one starting with %q", logs[0], want)
+	}
+}
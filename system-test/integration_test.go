@@ -18,8 +18,12 @@ package e2e
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
+	"log"
+	"net"
+	"net/http"
 	"os"
 	"runtime"
 	"strings"
@@ -29,27 +33,66 @@ import (
 
 	"cloud.google.com/go/profiler/proftest"
 	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
 )
 
 var (
-	repo           = flag.String("repo", "https://github.com/googleapis/cloud-profiler-nodejs.git", "git repo to test")
-	branch         = flag.String("branch", "", "git branch to test")
-	commit         = flag.String("commit", "", "git commit to test")
-	pr             = flag.Int("pr", 0, "git pull request to test")
-	runBackoffTest = flag.Bool("run_backoff_test", false, "Enables the backoff integration test. This integration test requires over 45 mins to run, so it is not run by default.")
+	repo              = flag.String("repo", "https://github.com/googleapis/cloud-profiler-nodejs.git", "git repo to test")
+	branch            = flag.String("branch", "", "git branch to test")
+	commit            = flag.String("commit", "", "git commit to test")
+	pr                = flag.Int("pr", 0, "git pull request to test")
+	runBackoffTest    = flag.Bool("run_backoff_test", false, "Enables the backoff integration test. This integration test requires over 45 mins to run, so it is not run by default.")
+	googleapisAddress = flag.String("googleapis_address", "", "If set, host:port to connect to for requests the test makes to *.googleapis.com, in place of the address DNS returns. Use private.googleapis.com:443 to reach Google APIs through Private Google Access or Private Service Connect, or restricted.googleapis.com:443 from inside a VPC Service Controls perimeter.")
+	logRequests       = flag.Bool("log_requests", false, "Log each request the test makes to Google APIs, with its response status.")
+	vpcSC             = flag.Bool("vpc_sc", false, "Route requests the test makes to Google APIs through restricted.googleapis.com, as required inside a VPC Service Controls perimeter. Same as -googleapis_address=restricted.googleapis.com:443.")
+	smokeTest         = flag.Bool("smoke_test", false, "Only check that the agent starts on each VM. The test stops waiting once the agent logs its version, without waiting for the benchmark to finish or querying profiles.")
+	quotaProject      = flag.String("quota_project", "", "Project to charge for quota and billing of the API requests the test makes, if it differs from the project of the credentials. Sets the X-Goog-User-Project header.")
+	failurePatterns   = flag.String("failure_patterns", "UnhandledPromiseRejectionWarning,Failed to initialize SourceMapper", "Comma-separated list of strings which show that the agent or the benchmark ran into an error. The test fails if the serial output of a completed benchmark contains any of them. The default only lists messages which Node.js and the agent print when something has gone wrong; broader strings such as \"Error:\" also match the warnings the agent logs before retrying a failed request.")
+	computeEndpoint   = flag.String("compute_endpoint", "", "Base URL of the Compute Engine API, such as the URL of a local fake. Defaults to the production endpoint.")
 
-	runID             = strings.Replace(time.Now().Format("2006-01-02-15-04-05.000000-0700"), ".", "-", -1)
 	benchFinishString = "benchmark application(s) complete"
+	benchStartString  = "benchmark application started at"
+	benchEndString    = "benchmark application ended at"
 	errorString       = "failed to set up or run the benchmark"
+
+	// agentStartString is logged by the agent, at debug level, when it starts.
+	agentStartString = "Cloud Profiler Node.js agent version"
 )
 
 const (
-	cloudScope       = "https://www.googleapis.com/auth/cloud-platform"
+	cloudScope = "https://www.googleapis.com/auth/cloud-platform"
+
+	// restrictedGoogleapisAddress is the address of the restricted Google APIs
+	// VIP, the only way to reach Google APIs inside a VPC Service Controls
+	// perimeter.
+	restrictedGoogleapisAddress = "restricted.googleapis.com:443"
+
 	gceBenchDuration = 600 * time.Second
 	gceTestTimeout   = 25 * time.Minute
 
+	// queryEndMargin is how far before the current time the profile query
+	// window ends. The profiler backend may reject an end time which is in its
+	// future, or return nothing for it, so this keeps the end time in the past
+	// even if the test host's clock runs up to this far ahead of the backend's.
+	// A fixed margin needs no extra request to learn the backend's time, and
+	// the test does not need the profiles collected in the last minute.
+	queryEndMargin = time.Minute
+
+	// queryStartMargin is how much further back than the benchmark duration
+	// the profile query window starts. It allows for the benchmark running
+	// longer than requested, for the delay before the test sees the finish
+	// marker, and for the test host's clock running up to this far ahead of
+	// the backend's.
+	queryStartMargin = 5 * time.Minute
+
+	// progressLogInterval is how often the test logs that it is still waiting
+	// for an instance to start or a benchmark to finish.
+	progressLogInterval = 5 * time.Minute
+
 	// For any agents to receive backoff, there must be more than 32 agents in
 	// the deployment. The initial backoff received will be 33 minutes; each
 	// subsequent backoff will be one minute longer. Running 45 benchmarks for
@@ -112,7 +155,9 @@ npm run compile
 {{- template "prologue" . }}
 {{- template "setup" . }}
 # Run benchmark with agent
+echo "{{.StartString}} $(date +%s)"
 GCLOUD_PROFILER_LOGLEVEL=5 GAE_SERVICE={{.Service}} node --trace-warnings build/src/busybench.js {{.DurationSec}}
+echo "{{.EndString}} $(date +%s)"
 
 # Indicate to test that script has finished running
 echo "{{.FinishString}}"
@@ -179,6 +224,8 @@ func (tc *nodeGCETestCase) initializeStartUpScript(template *template.Template)
 		Branch               string
 		Commit               string
 		FinishString         string
+		StartString          string
+		EndString            string
 		ErrorString          string
 		DurationSec          int
 		NumBackoffBenchmarks int
@@ -190,6 +237,8 @@ func (tc *nodeGCETestCase) initializeStartUpScript(template *template.Template)
 		Branch:       *branch,
 		Commit:       *commit,
 		FinishString: benchFinishString,
+		StartString:  benchStartString,
+		EndString:    benchEndString,
 		ErrorString:  errorString,
 		DurationSec:  int(tc.benchDuration.Seconds()),
 	}
@@ -209,6 +258,36 @@ func (tc *nodeGCETestCase) initializeStartUpScript(template *template.Template)
 	return nil
 }
 
+// newTransport returns a copy of http.DefaultTransport which makes
+// connections to Google APIs to googleapisAddress, if it is set.
+func newTransport(googleapisAddress string) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, googleapisDialAddress(addr, googleapisAddress))
+	}
+	return transport
+}
+
+// newHTTPClient returns a client which authorizes requests with the default
+// credentials and sends them through base. The profiler queries and the
+// compute service both use this client, so base sees all of the test's API
+// traffic.
+func newHTTPClient(ctx context.Context, base http.RoundTripper) (*http.Client, error) {
+	ts, err := google.DefaultTokenSource(ctx, cloudScope)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: &oauth2.Transport{Source: ts, Base: base}}, nil
+}
+
+// isNotFound reports whether err, or an error it wraps, is a googleapi error
+// with status 404 Not Found.
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
 func TestAgentIntegration(t *testing.T) {
 	projectID := os.Getenv("GCLOUD_TESTS_NODEJS_PROJECT_ID")
 	if projectID == "" {
@@ -224,14 +303,36 @@ func TestAgentIntegration(t *testing.T) {
 		t.Fatal("commit flag is not set")
 	}
 
+	patterns := parseFailurePatterns(*failurePatterns)
+
 	ctx := context.Background()
 
-	client, err := google.DefaultClient(ctx, cloudScope)
+	address := *googleapisAddress
+	if *vpcSC {
+		if address != "" && address != restrictedGoogleapisAddress {
+			t.Fatalf("-vpc_sc connects to %s and cannot be combined with -googleapis_address=%s", restrictedGoogleapisAddress, address)
+		}
+		address = restrictedGoogleapisAddress
+	}
+
+	var transport http.RoundTripper = newTransport(address)
+	if *quotaProject != "" {
+		transport = &userProjectTransport{base: transport, project: *quotaProject}
+	}
+	if *logRequests {
+		transport = &loggingTransport{base: transport, logf: log.Printf}
+	}
+
+	client, err := newHTTPClient(ctx, transport)
 	if err != nil {
 		t.Fatalf("failed to get default client: %v", err)
 	}
 
-	computeService, err := compute.New(client)
+	computeOpts := []option.ClientOption{option.WithHTTPClient(client)}
+	if *computeEndpoint != "" {
+		computeOpts = append(computeOpts, option.WithEndpoint(*computeEndpoint))
+	}
+	computeService, err := compute.NewService(ctx, computeOpts...)
 	if err != nil {
 		t.Fatalf("failed to initialize compute Service: %v", err)
 	}
@@ -258,10 +359,10 @@ func TestAgentIntegration(t *testing.T) {
 			InstanceConfig: proftest.InstanceConfig{
 				ProjectID:   projectID,
 				Zone:        zone,
-				Name:        fmt.Sprintf("profiler-test-node10-%s", runID),
+				Name:        resourceName("profiler-test-node10"),
 				MachineType: "n1-standard-1",
 			},
-			name:          fmt.Sprintf("profiler-test-node10-%s-gce", runID),
+			name:          resourceName("profiler-test-node10") + "-gce",
 			wantProfiles:  wantProfiles,
 			nodeVersion:   "10",
 			timeout:       gceTestTimeout,
@@ -271,10 +372,10 @@ func TestAgentIntegration(t *testing.T) {
 			InstanceConfig: proftest.InstanceConfig{
 				ProjectID:   projectID,
 				Zone:        zone,
-				Name:        fmt.Sprintf("profiler-test-node12-%s", runID),
+				Name:        resourceName("profiler-test-node12"),
 				MachineType: "n1-standard-1",
 			},
-			name:          fmt.Sprintf("profiler-test-node12-%s-gce", runID),
+			name:          resourceName("profiler-test-node12") + "-gce",
 			wantProfiles:  wantProfiles,
 			nodeVersion:   "12",
 			timeout:       gceTestTimeout,
@@ -284,10 +385,10 @@ func TestAgentIntegration(t *testing.T) {
 			InstanceConfig: proftest.InstanceConfig{
 				ProjectID:   projectID,
 				Zone:        zone,
-				Name:        fmt.Sprintf("profiler-test-node13-%s", runID),
+				Name:        resourceName("profiler-test-node13"),
 				MachineType: "n1-standard-1",
 			},
-			name:          fmt.Sprintf("profiler-test-node13-%s-gce", runID),
+			name:          resourceName("profiler-test-node13") + "-gce",
 			wantProfiles:  wantProfiles,
 			nodeVersion:   "12",
 			timeout:       gceTestTimeout,
@@ -301,14 +402,14 @@ func TestAgentIntegration(t *testing.T) {
 				InstanceConfig: proftest.InstanceConfig{
 					ProjectID: projectID,
 					Zone:      zone,
-					Name:      fmt.Sprintf("profiler-backoff-test-node12-%s", runID),
+					Name:      resourceName("profiler-backoff-test-node12"),
 
 					// Running many copies of the benchmark requires more
 					// memory than is available on an n1-standard-1. Use a
 					// machine type with more memory for backoff test.
 					MachineType: "n1-highmem-2",
 				},
-				name:          fmt.Sprintf("profiler-backoff-test-node12-%s", runID),
+				name:          resourceName("profiler-backoff-test-node12"),
 				backoffTest:   true,
 				nodeVersion:   "12",
 				timeout:       backoffTestTimeout,
@@ -327,22 +428,33 @@ func TestAgentIntegration(t *testing.T) {
 				t.Fatalf("failed to initialize startup script: %v", err)
 			}
 
+			stopProgress := logProgress(log.Printf, progressLogInterval, fmt.Sprintf("GCE instance %s to start", tc.Name))
 			err := gceTr.StartInstance(ctx, &tc.InstanceConfig)
+			stopProgress()
 			if err != nil {
 				t.Fatalf("failed to start GCE instance: %v", err)
 			}
 			defer func() {
-				if gceTr.DeleteInstance(ctx, &tc.InstanceConfig); err != nil {
-					t.Fatal(err)
+				if err := gceTr.DeleteInstance(ctx, &tc.InstanceConfig); err != nil && !isNotFound(err) {
+					t.Errorf("failed to delete GCE instance: %v", err)
 				}
 			}()
 
 			timeoutCtx, cancel := context.WithTimeout(ctx, tc.timeout)
 			defer cancel()
-			output, err := gceTr.PollForAndReturnSerialOutput(timeoutCtx, &tc.InstanceConfig, benchFinishString, errorString)
+			waitFor := benchFinishString
+			if *smokeTest {
+				waitFor = agentStartString
+			}
+			stopProgress = logProgress(log.Printf, progressLogInterval, fmt.Sprintf("%q in serial output of %s", waitFor, tc.Name))
+			output, err := gceTr.PollForAndReturnSerialOutput(timeoutCtx, &tc.InstanceConfig, waitFor, errorString)
+			stopProgress()
 			if err != nil {
 				t.Fatal(err)
 			}
+			if *smokeTest {
+				return
+			}
 
 			if tc.backoffTest {
 				if err := proftest.CheckSerialOutputForBackoffs(output, numBackoffBenchmarks, "action throttled, backoff", "Attempting to create profile", "benchmark"); err != nil {
@@ -351,9 +463,22 @@ func TestAgentIntegration(t *testing.T) {
 				return
 			}
 
-			timeNow := time.Now()
-			endTime := timeNow.Format(time.RFC3339)
-			startTime := timeNow.Add(-1 * time.Hour).Format(time.RFC3339)
+			if lines := failureLines(output, patterns); len(lines) > 0 {
+				t.Errorf("benchmark completed, but its serial output has lines matching -failure_patterns:\n%s", strings.Join(lines, "\n"))
+			}
+
+			if runDuration, err := benchmarkRunDuration(output, benchStartString, benchEndString); err != nil {
+				t.Errorf("failed to determine how long the benchmark ran: %v", err)
+			} else if runDuration < tc.benchDuration {
+				t.Errorf("benchmark ran for %v, want at least %v", runDuration, tc.benchDuration)
+			}
+
+			// The query window reaches back over the benchmark duration plus
+			// queryStartMargin from when the finish marker was seen, and ends
+			// queryEndMargin before then.
+			runEnd := time.Now()
+			endTime := runEnd.Add(-queryEndMargin).Format(time.RFC3339)
+			startTime := runEnd.Add(-tc.benchDuration - queryStartMargin).Format(time.RFC3339)
 			for _, wantProfile := range tc.wantProfiles {
 				pr, err := gceTr.TestRunner.QueryProfilesWithZone(tc.ProjectID, tc.name, startTime, endTime, wantProfile.profileType, tc.Zone)
 				if err != nil {